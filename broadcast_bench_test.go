@@ -0,0 +1,75 @@
+package buddy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newBenchSession builds a Session wired to an open mock Client whose send
+// channel is drained by the caller between iterations, standing in for a
+// live websocket/SSE connection in the benchmarks below.
+func newBenchSession(token SessionToken) *Session {
+	client := &Client{
+		open: true,
+		send: make(chan []byte, 1),
+	}
+	session := NewSession(token)
+	session.Client = client
+	client.session = session
+	return session
+}
+
+// benchSessionStore builds a defaultSessionStore pre-populated with n mock
+// sessions, returning it alongside the sessions slice so a benchmark can
+// drain each one's send channel between iterations.
+func benchSessionStore(n int) (*defaultSessionStore, []*Session) {
+	store := NewDefaultSessionManager(0).(*defaultSessionStore)
+	sessions := make([]*Session, n)
+	for i := 0; i < n; i++ {
+		session := newBenchSession(SessionToken(strconv.Itoa(i)))
+		store.sessions[session.Token] = session
+		sessions[i] = session
+	}
+	return store, sessions
+}
+
+func drainBenchSessions(sessions []*Session) {
+	for _, session := range sessions {
+		select {
+		case <-session.Client.send:
+		default:
+		}
+	}
+}
+
+const benchClientCount = 10000
+
+// BenchmarkDeliverLocalNow measures the pre-pacing delivery path: every
+// session's send channel gets the message in the same call.
+func BenchmarkDeliverLocalNow(b *testing.B) {
+	store, sessions := benchSessionStore(benchClientCount)
+	svr := &Server{sessions: store}
+	message := []byte("benchmark broadcast payload")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svr.deliverLocalNow(message)
+		drainBenchSessions(sessions)
+	}
+}
+
+// BenchmarkDeliverLocalPaced measures the same fan-out spread across a
+// BroadcastPacing window, to justify the DelayedChan redesign against the
+// unpaced baseline above at the same client count.
+func BenchmarkDeliverLocalPaced(b *testing.B) {
+	store, sessions := benchSessionStore(benchClientCount)
+	svr := &Server{sessions: store, BroadcastPacing: 50 * time.Millisecond}
+	message := []byte("benchmark broadcast payload")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svr.deliverLocalPaced(message)
+		drainBenchSessions(sessions)
+	}
+}
@@ -0,0 +1,30 @@
+package buddy
+
+import "time"
+
+// Broadcaster periodically re-publishes a shared "current state" blob so a
+// client that just (re)connected, on this node or any other sharing the
+// same Broker, is brought up to date within one interval instead of
+// waiting for the next organic broadcast.
+type Broadcaster struct {
+	server   *Server
+	interval time.Duration
+	state    func() []byte
+}
+
+// NewBroadcaster builds a Broadcaster that calls state on each tick and
+// broadcasts whatever it returns through server.
+func NewBroadcaster(server *Server, interval time.Duration, state func() []byte) *Broadcaster {
+	return &Broadcaster{server: server, interval: interval, state: state}
+}
+
+// Run blocks, broadcasting the current state every interval. Call it in
+// its own goroutine alongside Server.Run.
+func (b *Broadcaster) Run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.server.broadcastAll(b.state())
+	}
+}
@@ -0,0 +1,48 @@
+package buddy
+
+import "time"
+
+// Broker fans broadcast messages out to every server process and tracks
+// which node a session is currently connected to. A single-process server
+// uses NewNoopBroker, which keeps everything in-process exactly as it
+// behaved before brokers existed.
+type Broker interface {
+	Publish(channel string, message []byte) error
+	Subscribe(channel string) (<-chan []byte, error)
+
+	// Heartbeat refreshes a session's presence entry with a fresh TTL.
+	Heartbeat(token SessionToken, ttl time.Duration) error
+
+	// PresenceRange calls f for every session with a live presence entry,
+	// across every node sharing this broker. Iteration stops early if f
+	// returns false.
+	PresenceRange(f func(token SessionToken, nodeID string) bool) error
+}
+
+// NoopBroker loops published messages straight back to the same process's
+// Subscribe channel and keeps no presence information, since a single node
+// already knows about all of its own sessions.
+type NoopBroker struct {
+	ch chan []byte
+}
+
+func NewNoopBroker() *NoopBroker {
+	return &NoopBroker{ch: make(chan []byte, broadcastChannelSize)}
+}
+
+func (b *NoopBroker) Publish(channel string, message []byte) error {
+	b.ch <- message
+	return nil
+}
+
+func (b *NoopBroker) Subscribe(channel string) (<-chan []byte, error) {
+	return b.ch, nil
+}
+
+func (b *NoopBroker) Heartbeat(token SessionToken, ttl time.Duration) error {
+	return nil
+}
+
+func (b *NoopBroker) PresenceRange(f func(token SessionToken, nodeID string) bool) error {
+	return nil
+}
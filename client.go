@@ -1,4 +1,4 @@
-package carrot
+package buddy
 
 import (
 	"bytes"
@@ -6,6 +6,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"math"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -20,9 +22,6 @@ const (
 	// time allowed to read the next pong message from the websocket
 	pongWait = pongWaitSeconds * time.Second
 
-	// send pings to the websocket with this period, must be less than pongWait
-	pingPeriod = (pongWait * 9) / 10
-
 	// maximum message size allowed from the websocket
 	maxMessageSize = 8192
 
@@ -43,9 +42,20 @@ var (
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// ackFramePrefix marks an inbound control frame the JS client sends to
+// report the highest replay sequence number (see encodeSequenced) it has
+// rendered, e.g. "ack:42", so the server can prune its replay buffer.
+const ackFramePrefix = "ack:"
+
+func parseAckFrame(message []byte) (uint64, bool) {
+	if !bytes.HasPrefix(message, []byte(ackFramePrefix)) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(bytes.TrimPrefix(message, []byte(ackFramePrefix))), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
 }
 
 type Client struct {
@@ -55,8 +65,27 @@ type Client struct {
 	start chan struct{}
 	open  bool
 
+	// conn is only set (and only touched) for websocket clients; readPump
+	// reads inbound frames straight off it. SSE clients leave it nil since
+	// their inbound path is the /events/send handler instead.
 	conn *websocket.Conn
 
+	// transport is the outbound path, shared by both websocket and SSE
+	// clients; see transport.go.
+	transport Transport
+
+	// pendingSend holds a message writePump already pulled off send but
+	// couldn't fold into the batch it just wrote (see nextSendBatch), so
+	// it becomes the next batch's first message instead of being read
+	// off the channel twice.
+	pendingSend []byte
+
+	config ClientConfig
+
+	// clientIP is the resolved real client address (see realClientIP in
+	// ip.go), copied onto the Session in SetClient once one exists.
+	clientIP netip.Addr
+
 	//buffered channel of outbound messages
 	send chan []byte
 
@@ -93,7 +122,7 @@ func (c *Client) Expired() bool {
 
 func (c *Client) Full() bool {
 	// check for buffer full
-	if len(c.send) == sendMsgBufferSize {
+	if len(c.send) == c.config.SendMsgBufferSize {
 		return true
 	}
 
@@ -107,7 +136,7 @@ func (c *Client) Valid() bool {
 
 func (c *Client) logBufferRedZone() {
 	// check for buffer warning
-	if len(c.send) > int(math.Floor(sendMsgBufferSize*sendMsgBufferWarningTrigger)) {
+	if len(c.send) > int(math.Floor(float64(c.config.SendMsgBufferSize)*sendMsgBufferWarningTrigger)) {
 		c.logger.WithFields(log.Fields{
 			"open?":   c.Open(),
 			"size":    len(c.send),
@@ -116,7 +145,7 @@ func (c *Client) logBufferRedZone() {
 }
 
 func (c *Client) logBufferFull() {
-	if len(c.send) == sendMsgBufferSize {
+	if len(c.send) == c.config.SendMsgBufferSize {
 		c.logger.WithFields(log.Fields{
 			"open?":   c.Open(),
 			"size":    len(c.send),
@@ -130,9 +159,9 @@ func (c *Client) readPump() {
 		c.server.unregister <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadLimit(c.config.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.config.PongWait)); return nil })
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -143,6 +172,11 @@ func (c *Client) readPump() {
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 
+		if seq, ok := parseAckFrame(message); ok {
+			c.session.recordAck(seq)
+			continue
+		}
+
 		req := NewRequest(c.session, message)
 		c.logger.WithField("session_token", c.session.Token).Debug("request being sent to middleware")
 		c.server.Middleware.In <- req
@@ -150,68 +184,96 @@ func (c *Client) readPump() {
 	}
 }
 
-//writePump pumps messages from the hub to the websocket connection
+// nextSendBatch coalesces any other messages already queued on c.send into
+// first, stopping as soon as it hits one whose opaqueness (see
+// isOpaqueFrame) doesn't match first's. An opaque frame must ship alone,
+// since wsTransport's opaque check only looks at the start of the whole
+// batch; a mismatched message is stashed in c.pendingSend instead of being
+// dropped, so it leads off the next batch.
+func (c *Client) nextSendBatch(first []byte) []byte {
+	batch := first
+	opaque := isOpaqueFrame(first)
+	if opaque {
+		// an opaque frame ships alone, full stop; don't even check
+		// whether what follows is opaque too, since two opaque frames
+		// coalesced together would still leave the second one's marker
+		// byte stuck in the middle of the batch.
+		return batch
+	}
+
+	n := len(c.send)
+	for i := 0; i < n; i++ {
+		next := <-c.send
+		if isOpaqueFrame(next) != opaque {
+			c.pendingSend = next
+			break
+		}
+		batch = append(batch, newline...)
+		batch = append(batch, next...)
+	}
+
+	return batch
+}
+
+//writePump pumps messages from the hub to the client's transport
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.config.pingPeriod())
 	defer func() {
 		ticker.Stop()
-		c.conn.Close()
+		c.transport.Close()
 	}()
 	for {
+		if c.pendingSend != nil {
+			message := c.pendingSend
+			c.pendingSend = nil
+			if err := c.transport.WriteMessage(c.nextSendBatch(message)); err != nil {
+				return
+			}
+			continue
+		}
+
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// TODO: add session token to here once client list is updated
 				c.logger.Error("a connection has closed\n")
 				//the server closed the channel
-				//c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
 				return
 			}
-			w.Write(message)
 
-			//add queued messages to the current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if err := c.transport.WriteMessage(c.nextSendBatch(message)); err != nil {
 				return
 			}
 		case token, ok := <-c.sendToken:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				//the server closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write([]byte(token))
+			batch := []byte(token)
 
-			//add queued messages to the current websocket message
+			//add queued tokens to the same batch
 			n := len(c.sendToken)
 			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write([]byte(<-c.sendToken))
+				batch = append(batch, newline...)
+				batch = append(batch, []byte(<-c.sendToken)...)
 			}
 
-			if err := w.Close(); err != nil {
+			if err := c.transport.WriteMessage(batch); err != nil {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if c.session != nil {
+				// Same deadline-free Heartbeat as Run's register case; run
+				// it off to the side so a slow broker can't stall this
+				// client's own Ping and queued sends.
+				go func(token SessionToken) {
+					if err := c.server.Broker.Heartbeat(token, c.config.presenceTTL()); err != nil {
+						c.logger.WithError(err).Error("heartbeat failed")
+					}
+				}(c.session.Token)
+			}
+			if err := c.transport.Ping(); err != nil {
 				return
 			}
 		}
@@ -237,22 +299,32 @@ func serveWs(server *Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := server.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	config := server.ClientConfig
+	if config.EnableCompression {
+		conn.SetCompressionLevel(config.CompressionLevel)
+	}
+
+	clientIP := realClientIP(r, server.TrustedProxies)
+
 	client := &Client{
 		session:   nil,
 		server:    server,
 		conn:      conn,
-		send:      make(chan []byte, sendMsgBufferSize),
+		transport: newWSTransport(conn, config),
+		config:    config,
+		clientIP:  clientIP,
+		send:      make(chan []byte, config.SendMsgBufferSize),
 		sendToken: make(chan SessionToken, sendTokenBufferSize),
 		start:     make(chan struct{}),
 		open:      false,
 		openMutex: &sync.RWMutex{},
-		logger:    log.WithField("module", "client"),
+		logger:    log.WithField("module", "client").WithField("client_ip", clientIP),
 	}
 
 	client.sendToken <- SessionToken(sessionToken)
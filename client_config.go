@@ -0,0 +1,66 @@
+package buddy
+
+import "time"
+
+// ClientConfig controls per-connection limits and the websocket upgrader.
+// NewServer defaults to the values this package always used; override with
+// WithClientConfig for larger buffers, different timeouts, or
+// permessage-deflate compression.
+type ClientConfig struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxMessageSize is the largest inbound websocket message readPump
+	// will accept before dropping the connection.
+	MaxMessageSize int64
+
+	// WriteWait bounds how long a single write may take before the
+	// connection is considered dead.
+	WriteWait time.Duration
+	// PongWait bounds how long to wait for a pong before the connection is
+	// considered dead; pings go out at 9/10 of this interval.
+	PongWait time.Duration
+
+	// SendMsgBufferSize is the capacity of a Client's outbound message
+	// channel.
+	SendMsgBufferSize int
+
+	// EnableCompression turns on permessage-deflate for the websocket
+	// upgrade negotiation.
+	EnableCompression bool
+	// CompressionLevel is passed to Conn.SetCompressionLevel when
+	// EnableCompression is set; see compress/flate for valid values.
+	CompressionLevel int
+	// CompressionContextTakeover requests the deflate window persist
+	// across messages instead of resetting on every frame. gorilla/
+	// websocket doesn't currently expose negotiating this, so it's
+	// advisory until it does.
+	CompressionContextTakeover bool
+}
+
+func defaultClientConfig() ClientConfig {
+	return ClientConfig{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		MaxMessageSize:    maxMessageSize,
+		WriteWait:         writeWait,
+		PongWait:          pongWait,
+		SendMsgBufferSize: sendMsgBufferSize,
+		CompressionLevel:  -1, // flate.DefaultCompression
+	}
+}
+
+// pingPeriod is how often writePump sends a ping; it must stay under
+// PongWait or a slow-but-alive peer would get dropped for not ponging in
+// time.
+func (cfg ClientConfig) pingPeriod() time.Duration {
+	return (cfg.PongWait * 9) / 10
+}
+
+// presenceTTL is how long a Broker presence entry (see Broker.Heartbeat)
+// stays live after being refreshed. It's a multiple of pingPeriod so a
+// node that misses a couple of ping cycles (a GC pause, a brief network
+// blip) doesn't have its sessions' presence expire out from under it.
+func (cfg ClientConfig) presenceTTL() time.Duration {
+	return cfg.pingPeriod() * 3
+}
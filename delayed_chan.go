@@ -0,0 +1,39 @@
+package buddy
+
+import "time"
+
+// DelayedChan is a buffered queue of values that shouldn't be released
+// until their own scheduled time, used to spread broadcast fan-out over a
+// window instead of letting every writePump wake at once. Pop blocks on
+// the channel itself (so a caller waiting with nothing pushed yet just
+// waits, same as a plain channel) and then, once it has an item, sleeps
+// out whatever's left of that item's delay.
+type DelayedChan struct {
+	ch chan delayedItem
+}
+
+type delayedItem struct {
+	value       interface{}
+	releaseTime time.Time
+}
+
+func NewDelayedChan(size int) *DelayedChan {
+	return &DelayedChan{ch: make(chan delayedItem, size)}
+}
+
+// Push enqueues value to be released no earlier than delay from now.
+// Pushes must happen in non-decreasing delay order for Pop's blocking
+// sleep to release items in the order they were queued.
+func (d *DelayedChan) Push(value interface{}, delay time.Duration) {
+	d.ch <- delayedItem{value: value, releaseTime: time.Now().Add(delay)}
+}
+
+// Pop blocks until the next item is both queued and past its release
+// time.
+func (d *DelayedChan) Pop() interface{} {
+	item := <-d.ch
+	if wait := time.Until(item.releaseTime); wait > 0 {
+		time.Sleep(wait)
+	}
+	return item.value
+}
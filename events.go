@@ -0,0 +1,164 @@
+package buddy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sseTransport implements Transport over a Server-Sent Events response, the
+// /events counterpart to the websocket connection serveWs sets up. Each
+// write is framed as one SSE event, tagged with an id that counts up from 1
+// on every new connection. The id is not a replay sequence number, and
+// serveEvents does not read a reconnecting browser's Last-Event-ID header;
+// a reconnect under the same session token catches up through the
+// session's replay buffer instead.
+type sseTransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	nextID  uint64
+}
+
+func newSSETransport(w http.ResponseWriter) (*sseTransport, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("buddy: response writer does not support flushing, cannot serve SSE")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	return &sseTransport{w: w, flusher: flusher}, nil
+}
+
+func (t *sseTransport) WriteMessage(data []byte) error {
+	// SSE has no compression to opt out of; just drop the marker so it
+	// doesn't show up as a literal byte in the event stream.
+	data = bytes.TrimPrefix(data, opaqueFrameMarker)
+
+	id := atomic.AddUint64(&t.nextID, 1)
+
+	if _, err := fmt.Fprintf(t.w, "id: %d\n", id); err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(data, newline) {
+		if _, err := fmt.Fprintf(t.w, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(t.w, "\n"); err != nil {
+		return err
+	}
+
+	t.flusher.Flush()
+	return nil
+}
+
+func (t *sseTransport) Ping() error {
+	if _, err := fmt.Fprint(t.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// Close is a no-op: there's no connection to tear down beyond returning
+// from serveEvents, which the request context unblocks.
+func (t *sseTransport) Close() error {
+	return nil
+}
+
+// serveEvents upgrades to text/event-stream and otherwise runs the exact
+// same Session/SessionStore/register/unregister lifecycle as serveWs.
+func serveEvents(server *Server, w http.ResponseWriter, r *http.Request) {
+	sessionToken, clientSecret, _ := r.BasicAuth()
+
+	if clientSecretRequired && !validClientSecret(clientSecret) {
+		http.Error(w, "Not Authorized!", 403)
+		return
+	}
+
+	transport, err := newSSETransport(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	config := server.ClientConfig
+	clientIP := realClientIP(r, server.TrustedProxies)
+
+	client := &Client{
+		session:   nil,
+		server:    server,
+		transport: transport,
+		config:    config,
+		clientIP:  clientIP,
+		send:      make(chan []byte, config.SendMsgBufferSize),
+		sendToken: make(chan SessionToken, sendTokenBufferSize),
+		start:     make(chan struct{}),
+		open:      false,
+		openMutex: &sync.RWMutex{},
+		logger:    log.WithField("module", "client").WithField("client_ip", clientIP),
+	}
+
+	client.sendToken <- SessionToken(sessionToken)
+	client.server.register <- client
+
+	go func() {
+		<-r.Context().Done()
+		client.server.unregister <- client
+	}()
+
+	// there's no readPump for SSE (inbound comes in over /events/send), so
+	// writePump blocks this handler goroutine for as long as the client
+	// stays connected.
+	client.writePump()
+}
+
+// serveEventsSend is the inbound counterpart to serveEvents: POST a raw
+// message under the same session token's Basic-Auth and it's handed to
+// Middleware.In exactly as readPump would for a websocket client.
+func serveEventsSend(server *Server, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionToken, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		http.Error(w, "Not Authorized!", http.StatusUnauthorized)
+		return
+	}
+	if clientSecretRequired && !validClientSecret(clientSecret) {
+		http.Error(w, "Not Authorized!", http.StatusForbidden)
+		return
+	}
+
+	session, ok := server.sessions.Get(SessionToken(sessionToken))
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, server.ClientConfig.MaxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body = bytes.TrimSpace(bytes.Replace(body, newline, space, -1))
+
+	if seq, ok := parseAckFrame(body); ok {
+		session.recordAck(seq)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	server.Middleware.In <- NewRequest(session, body)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package buddy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// realClientIP resolves the address of the actual client behind r, rather
+// than whatever reverse proxy (nginx, Caddy, Apache, k8s ingress) is
+// terminating the connection. If trusted is empty, this is opt-in: the
+// result is always r.RemoteAddr, unchanged.
+//
+// When the immediate peer is inside a trusted CIDR, X-Real-IP is preferred
+// when present; otherwise X-Forwarded-For is walked right-to-left (the
+// rightmost entries are the hops closest to us), skipping any address that
+// is itself inside a trusted CIDR, and the first one that isn't is taken
+// to be the real client.
+func realClientIP(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	remote := remoteAddr(r)
+
+	if len(trusted) == 0 || !isTrustedAddr(remote, trusted) {
+		return remote
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(realIP)); err == nil {
+			return addr
+		}
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				continue
+			}
+			if !isTrustedAddr(addr, trusted) {
+				return addr
+			}
+		}
+	}
+
+	return remote
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+func isTrustedAddr(addr netip.Addr, trusted []netip.Prefix) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
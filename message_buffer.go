@@ -0,0 +1,166 @@
+package buddy
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultSessionBufferSize bounds how many messages a single session's
+// MessageBuffer will hold regardless of MaxHoldingSeconds.
+const defaultSessionBufferSize = 256
+
+// globalMessageBufferCap bounds the total number of buffered messages held
+// across every session, so a burst of disconnects can't run the process out
+// of memory.
+const globalMessageBufferCap = 50000
+
+var (
+	globalBufferedMu    sync.Mutex
+	globalBufferedCount int
+)
+
+// BufferedMessage is a single outbound message held for a disconnected
+// client, tagged with the sequence it was assigned and when it was queued.
+type BufferedMessage struct {
+	Seq        uint64
+	Data       []byte
+	InsertedAt time.Time
+}
+
+// MessageBuffer is a per-session ring of outbound messages a client missed
+// while disconnected, so it can catch up on reconnect instead of losing
+// them. Entries older than MaxHoldingSeconds are dropped by the background
+// reaper (see defaultSessionStore.runReaper).
+type MessageBuffer struct {
+	mu                sync.Mutex
+	messages          []BufferedMessage
+	maxSize           int
+	maxHoldingSeconds int
+	nextSeq           uint64
+}
+
+func NewMessageBuffer(maxHoldingSeconds int, maxSize int) *MessageBuffer {
+	if maxSize <= 0 {
+		maxSize = defaultSessionBufferSize
+	}
+	return &MessageBuffer{
+		messages:          make([]BufferedMessage, 0, maxSize),
+		maxSize:           maxSize,
+		maxHoldingSeconds: maxHoldingSeconds,
+	}
+}
+
+// Push appends message to the buffer, assigning it the next sequence
+// number. The oldest entry is evicted when the session's own cap or the
+// global cap is exceeded.
+func (b *MessageBuffer) Push(data []byte) uint64 {
+	if b == nil || b.maxHoldingSeconds <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextSeq++
+	seq := b.nextSeq
+
+	if len(b.messages) >= b.maxSize {
+		b.evictOldestLocked()
+	}
+	if globalBufferedCountAtCap() {
+		b.evictOldestLocked()
+	}
+
+	b.messages = append(b.messages, BufferedMessage{
+		Seq:        seq,
+		Data:       data,
+		InsertedAt: time.Now(),
+	})
+	incrGlobalBufferedCount(1)
+
+	return seq
+}
+
+// Live returns buffered messages with Seq > after that haven't yet aged
+// past maxHoldingSeconds, in insertion (and therefore sequence) order.
+func (b *MessageBuffer) Live(after uint64) []BufferedMessage {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(b.maxHoldingSeconds) * time.Second)
+	live := make([]BufferedMessage, 0, len(b.messages))
+	for _, m := range b.messages {
+		if m.Seq <= after || m.InsertedAt.Before(cutoff) {
+			continue
+		}
+		live = append(live, m)
+	}
+	return live
+}
+
+// PruneAcked drops every message with Seq <= ack, called when a session
+// records an ack control frame ahead of the reaper's TTL sweep.
+func (b *MessageBuffer) PruneAcked(ack uint64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropWhereLocked(func(m BufferedMessage) bool { return m.Seq <= ack })
+}
+
+// reap drops entries older than maxHoldingSeconds. Invoked periodically by
+// defaultSessionStore.runReaper.
+func (b *MessageBuffer) reap() {
+	if b == nil || b.maxHoldingSeconds <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(b.maxHoldingSeconds) * time.Second)
+	b.dropWhereLocked(func(m BufferedMessage) bool { return m.InsertedAt.Before(cutoff) })
+}
+
+// evictOldestLocked drops the single oldest buffered message. Caller must
+// hold b.mu.
+func (b *MessageBuffer) evictOldestLocked() {
+	if len(b.messages) == 0 {
+		return
+	}
+	b.messages = b.messages[1:]
+	incrGlobalBufferedCount(-1)
+}
+
+// dropWhereLocked removes every message matching drop. Caller must hold b.mu.
+func (b *MessageBuffer) dropWhereLocked(drop func(BufferedMessage) bool) {
+	kept := b.messages[:0]
+	dropped := 0
+	for _, m := range b.messages {
+		if drop(m) {
+			dropped++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	b.messages = kept
+	incrGlobalBufferedCount(-dropped)
+}
+
+func globalBufferedCountAtCap() bool {
+	globalBufferedMu.Lock()
+	defer globalBufferedMu.Unlock()
+	return globalBufferedCount >= globalMessageBufferCap
+}
+
+func incrGlobalBufferedCount(delta int) {
+	globalBufferedMu.Lock()
+	globalBufferedCount += delta
+	globalBufferedMu.Unlock()
+}
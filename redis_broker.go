@@ -0,0 +1,97 @@
+package buddy
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const presenceHashKey = "buddy:presence"
+
+// RedisBroker implements Broker on top of Redis pub/sub for message
+// fan-out and a Redis hash for session presence, so a deployment can run
+// more than one Server process behind a shared set of sessions.
+type RedisBroker struct {
+	client *redis.Client
+
+	// nodeID identifies this process in presence entries written to Redis.
+	nodeID string
+}
+
+func NewRedisBroker(client *redis.Client, nodeID string) *RedisBroker {
+	return &RedisBroker{client: client, nodeID: nodeID}
+}
+
+type presenceEntry struct {
+	NodeID     string    `json:"node_id"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+func (b *RedisBroker) Publish(channel string, message []byte) error {
+	return b.client.Publish(context.Background(), channel, message).Err()
+}
+
+func (b *RedisBroker) Subscribe(channel string) (<-chan []byte, error) {
+	pubsub := b.client.Subscribe(context.Background(), channel)
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		return nil, err
+	}
+
+	out := make(chan []byte, broadcastChannelSize)
+	go func() {
+		defer close(out)
+		for msg := range pubsub.Channel() {
+			out <- []byte(msg.Payload)
+		}
+	}()
+
+	return out, nil
+}
+
+// Heartbeat refreshes this session's presence entry, pointing it at
+// nodeID with a fresh expiry of ttl. Callers (see client.go and Run in
+// server.go) refresh on the same period as the websocket ping and pass
+// ClientConfig.presenceTTL, three ping periods, so a crashed node's
+// sessions drop out of presence once that ttl runs out.
+func (b *RedisBroker) Heartbeat(token SessionToken, ttl time.Duration) error {
+	entry, err := json.Marshal(presenceEntry{
+		NodeID:     b.nodeID,
+		ExpireTime: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.client.HSet(context.Background(), presenceHashKey, string(token), entry).Err()
+}
+
+// PresenceRange calls f for every session with a live presence entry
+// across all nodes sharing this broker. Expired entries are skipped and
+// removed as they're found.
+func (b *RedisBroker) PresenceRange(f func(token SessionToken, nodeID string) bool) error {
+	ctx := context.Background()
+
+	all, err := b.client.HGetAll(ctx, presenceHashKey).Result()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for tokenStr, raw := range all {
+		var entry presenceEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+		if now.After(entry.ExpireTime) {
+			b.client.HDel(ctx, presenceHashKey, tokenStr)
+			continue
+		}
+		if !f(SessionToken(tokenStr), entry.NodeID) {
+			return nil
+		}
+	}
+
+	return nil
+}
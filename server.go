@@ -3,19 +3,25 @@ package buddy
 import (
 	"flag"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"net/netip"
+	"time"
 )
 
 const serverSecret = "37FUqWlvJhRgwPMM1mlHOGyPNwkVna3b"
 const broadcastChannelSize = 512
+const defaultBrokerChannel = "buddy:broadcast"
+
+// maxBackpressureStrikes is how many consecutive broadcasts may find a
+// session's send channel full (with replay buffering disabled)
+// before deliverToSession gives up and closes the client.
+const maxBackpressureStrikes = 3
 
 //the server maintains the list of clients and
 //broadcasts messages to the clients
 type Server struct {
-	//inbound messages from the clients
-	broadcast chan []byte
-
 	//register requests from the clients
 	register chan *Client
 
@@ -27,19 +33,120 @@ type Server struct {
 
 	//keep track of middleware
 	Middleware *MiddlewarePipeline
+
+	//fans broadcasts out to every node (and, via NoopBroker, back to this
+	//one); see broker.go
+	Broker Broker
+
+	brokerChannel string
+
+	// ClientConfig is applied to every Client created by serveWs/serveEvents;
+	// see client_config.go.
+	ClientConfig ClientConfig
+
+	upgrader websocket.Upgrader
+
+	// pacedDeliveries feeds runPacedDelivery, the single goroutine that
+	// runs every paced broadcast's deliverLocalPaced one at a time; see
+	// BroadcastPacing.
+	pacedDeliveries chan []byte
+
+	// TrustedProxies lists the CIDRs a reverse proxy may connect from; when
+	// set, serveWs/serveEvents resolve the real client address through
+	// X-Forwarded-For/X-Real-IP instead of using r.RemoteAddr directly. See
+	// realClientIP in ip.go. Empty (the default) leaves behavior unchanged.
+	TrustedProxies []netip.Prefix
+
+	// BroadcastPacing spreads a single broadcast's deliveries across this
+	// window instead of handing every session's send channel a message in
+	// the same instant; 0 delivers instantaneously, as before this existed.
+	BroadcastPacing time.Duration
+
+	// SessionBufferTTL is how long a disconnected session's replay buffer
+	// holds onto missed broadcasts (Session.MaxHoldingSeconds); 0, the
+	// default, disables replay buffering entirely. See WithSessionBufferTTL.
+	SessionBufferTTL time.Duration
+}
+
+// ServerOption configures a Server at construction time.
+type ServerOption func(*Server)
+
+// WithBroker replaces the default NoopBroker, e.g. with a RedisBroker for
+// horizontal scale-out.
+func WithBroker(broker Broker) ServerOption {
+	return func(svr *Server) {
+		svr.Broker = broker
+	}
+}
+
+// WithClientConfig overrides the connection limits and websocket upgrader
+// settings new Clients are built with, e.g. to turn on permessage-deflate.
+func WithClientConfig(config ClientConfig) ServerOption {
+	return func(svr *Server) {
+		svr.ClientConfig = config
+	}
+}
+
+// WithTrustedProxies turns on X-Forwarded-For/X-Real-IP resolution for
+// connections arriving from the given CIDRs; see realClientIP in ip.go.
+func WithTrustedProxies(trusted []netip.Prefix) ServerOption {
+	return func(svr *Server) {
+		svr.TrustedProxies = trusted
+	}
+}
+
+// WithBroadcastPacing spreads each broadcast's deliveries across window
+// instead of handing every session's send channel a message at once.
+func WithBroadcastPacing(window time.Duration) ServerOption {
+	return func(svr *Server) {
+		svr.BroadcastPacing = window
+	}
 }
 
-func NewServer() *Server {
-	return &Server{
-		broadcast:  make(chan []byte, broadcastChannelSize),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		sessions:   NewDefaultSessionManager(),
-		Middleware: NewMiddlewarePipeline(),
+// WithSessionBufferTTL turns on replay buffering: a session whose Client
+// disconnects holds onto broadcasts for ttl so a reconnect can catch back
+// up (see Session.buf/replayTo). Without this option sessions never
+// buffer, matching behavior from before replay buffering existed.
+func WithSessionBufferTTL(ttl time.Duration) ServerOption {
+	return func(svr *Server) {
+		svr.SessionBufferTTL = ttl
 	}
 }
 
+func NewServer(opts ...ServerOption) *Server {
+	svr := &Server{
+		register:        make(chan *Client),
+		unregister:      make(chan *Client),
+		Middleware:      NewMiddlewarePipeline(),
+		Broker:          NewNoopBroker(),
+		brokerChannel:   defaultBrokerChannel,
+		ClientConfig:    defaultClientConfig(),
+		pacedDeliveries: make(chan []byte, broadcastChannelSize),
+	}
+
+	for _, opt := range opts {
+		opt(svr)
+	}
+
+	svr.sessions = NewDefaultSessionManager(int(svr.SessionBufferTTL.Seconds()))
+
+	svr.upgrader = websocket.Upgrader{
+		ReadBufferSize:    svr.ClientConfig.ReadBufferSize,
+		WriteBufferSize:   svr.ClientConfig.WriteBufferSize,
+		EnableCompression: svr.ClientConfig.EnableCompression,
+	}
+
+	return svr
+}
+
 func (svr *Server) Run() {
+	localDeliveries, err := svr.Broker.Subscribe(svr.brokerChannel)
+	if err != nil {
+		log.Fatalf("server: failed to subscribe to broker channel: %v", err)
+	}
+
+	go svr.runPacedDelivery()
+
 	for {
 		select {
 		case client := <-svr.register:
@@ -47,6 +154,7 @@ func (svr *Server) Run() {
 			token := <-client.sendToken
 			//create persistent token for new or invalid sessions
 			exists := svr.sessions.Exists(token)
+			reconnect := exists
 			if (token == "nil") || !exists {
 				var err error
 				token, err = svr.sessions.NewSession()
@@ -56,10 +164,28 @@ func (svr *Server) Run() {
 				}
 				//return the new token for the session
 				client.sendToken <- token
+				reconnect = false
 			}
 
 			svr.sessions.SetClient(token, client)
 
+			// Heartbeat has no deadline of its own (see RedisBroker.Heartbeat);
+			// run it off to the side so a slow/unreachable broker can't stall
+			// Run's single event loop for every other client.
+			go func(token SessionToken) {
+				if err := svr.Broker.Heartbeat(token, svr.ClientConfig.presenceTTL()); err != nil {
+					log.Printf("server: heartbeat failed: %v", err)
+				}
+			}(token)
+
+			if reconnect {
+				// replay whatever this session's buffer still holds so a
+				// briefly-disconnected client catches back up immediately
+				if session, ok := svr.sessions.Get(token); ok {
+					session.replayTo(client)
+				}
+			}
+
 		case client := <-svr.unregister:
 			if client.open {
 				client.open = false
@@ -68,56 +194,175 @@ func (svr *Server) Run() {
 				close(client.sendToken)
 				client = nil
 			}
-		case message := <-svr.broadcast:
-			svr.broadcastAll(message)
+		case message := <-localDeliveries:
+			svr.deliverLocal(message)
 		}
 	}
 }
 
+// broadcastAll publishes message through the configured Broker. For the
+// default NoopBroker that loops straight back to this node's subscriber
+// goroutine in Run; a real Broker (e.g. Redis) also fans it out to every
+// other node subscribed to the same channel.
 func (svr *Server) broadcastAll(message []byte) {
-	// start := time.Now()
-	expiredSessionCount := 0
-	closedClientCount := 0
-	refreshedClientCount := 0
-	messagesSent := 0
-	svr.sessions.Range(func(key, value interface{}) bool {
-		//out := fmt.Sprintf("On server: broadcast buffer size: %v", len(svr.broadcast))
-		//fmt.Printf("\r %v\n", out)
-		ctx := value.(*Session)
-
-		if ctx.SessionExpired() {
-			expiredSessionCount++
-			svr.sessions.Delete(ctx.Token)
-			return true
-		} else if !ctx.Client.open {
-			closedClientCount++
-			return true
-		}
+	if err := svr.Broker.Publish(svr.brokerChannel, message); err != nil {
+		log.Printf("server: broadcast publish failed: %v", err)
+	}
+}
+
+// deliverLocal hands message to every session whose Client lives on this
+// node. With BroadcastPacing unset it delivers to all of them immediately,
+// same as before pacing existed; otherwise it's queued for
+// runPacedDelivery so it's spread across the pacing window without
+// reordering relative to other paced broadcasts.
+func (svr *Server) deliverLocal(message []byte) {
+	if svr.BroadcastPacing <= 0 {
+		svr.deliverLocalNow(message)
+		return
+	}
 
-		ctx.expireTime = refreshExpiryTime()
-		refreshedClientCount++
+	svr.pacedDeliveries <- message
+}
 
-		select {
-		case ctx.Client.send <- message:
-			messagesSent++
-			return true
-		default:
-			close(ctx.Client.send)
-			close(ctx.Client.sendToken)
-		}
+// runPacedDelivery runs every paced broadcast's deliverLocalPaced call, one
+// at a time, for as long as Run is running. Running these one at a time
+// instead of one goroutine per broadcast matters: two broadcasts published
+// close together would otherwise each pick their own, independently
+// randomized (map-iteration-order) per-session delay, and a session could
+// end up with a long delay on the first broadcast but a short delay on the
+// second, receiving them out of order. Finishing broadcast N's delivery to
+// every session before broadcast N+1 starts preserves ordering.
+func (svr *Server) runPacedDelivery() {
+	for message := range svr.pacedDeliveries {
+		svr.deliverLocalPaced(message)
+	}
+}
+
+func (svr *Server) deliverLocalNow(message []byte) {
+	counts := &deliveryCounts{}
+
+	svr.sessions.Range(func(key, value interface{}) bool {
+		counts.record(svr.deliverToSession(value.(*Session), message))
+		return true
+	})
+
+	counts.log()
+}
 
-		return false
+// deliverLocalPaced spreads message out across svr.BroadcastPacing,
+// proportional to how many sessions there are to deliver to, using a
+// DelayedChan so one goroutine can release them in order instead of
+// spawning one timer per session.
+func (svr *Server) deliverLocalPaced(message []byte) {
+	var sessions []*Session
+	svr.sessions.Range(func(key, value interface{}) bool {
+		sessions = append(sessions, value.(*Session))
+		return true
 	})
-	fmt.Printf("\n")
-	log.Printf("server: broadcast expired %v, closed %v, refresh %v, sent %v",
-		expiredSessionCount,
-		closedClientCount,
-		refreshedClientCount,
-		messagesSent)
-	// end := time.Now()
-	// fmt.Printf("Time to broadcast to %v users: %v\n",
-	// 	svr.sessions.Length(),
-	// 	end.Sub(start))
+
+	n := len(sessions)
+	if n == 0 {
+		return
+	}
+
+	delayed := NewDelayedChan(n)
+	for i, session := range sessions {
+		delay := svr.BroadcastPacing * time.Duration(i) / time.Duration(n)
+		delayed.Push(session, delay)
+	}
+
+	counts := &deliveryCounts{}
+	for i := 0; i < n; i++ {
+		session := delayed.Pop().(*Session)
+		counts.record(svr.deliverToSession(session, message))
+	}
+
+	counts.log()
+}
+
+// deliveryOutcome classifies what happened when deliverToSession tried to
+// hand a session its message, for the per-broadcast summary log.
+type deliveryOutcome int
+
+const (
+	deliveryExpired deliveryOutcome = iota
+	deliverySent
+	deliveryBuffered
+	deliveryBackpressure
+	deliveryClosed
+)
+
+// deliverToSession hands message to ctx's Client if it's open and has
+// room, buffers it if the session has replay buffering enabled, or else
+// applies the strike-based backpressure policy: the first few full sends in
+// a row are tolerated (deliveryBackpressure), and only after
+// maxBackpressureStrikes in a row does the client actually get closed.
+func (svr *Server) deliverToSession(ctx *Session, message []byte) deliveryOutcome {
+	ctx.deliverMu.Lock()
+	defer ctx.deliverMu.Unlock()
+
+	if ctx.SessionExpired() {
+		svr.sessions.Delete(ctx.Token)
+		return deliveryExpired
+	}
+
+	if !ctx.Client.open {
+		// client isn't here to receive it right now, hold onto it so a
+		// reconnect can replay what it missed
+		ctx.buf().Push(message)
+		return deliveryClosed
+	}
+
+	ctx.expireTime = refreshExpiryTime()
+
+	select {
+	case ctx.Client.send <- message:
+		ctx.backpressureStrikes = 0
+		return deliverySent
+	default:
+	}
+
+	if buf := ctx.buf(); buf != nil {
+		buf.Push(message)
+		ctx.backpressureStrikes = 0
+		return deliveryBuffered
+	}
+
+	ctx.backpressureStrikes++
+	if ctx.backpressureStrikes < maxBackpressureStrikes {
+		return deliveryBackpressure
+	}
+
+	close(ctx.Client.send)
+	close(ctx.Client.sendToken)
+	ctx.backpressureStrikes = 0
+	return deliveryClosed
+}
+
+// deliveryCounts tallies deliverToSession outcomes across one broadcast
+// for the summary log deliverLocalNow/deliverLocalPaced end with.
+type deliveryCounts struct {
+	expired, sent, buffered, backpressure, closed int
+}
+
+func (c *deliveryCounts) record(outcome deliveryOutcome) {
+	switch outcome {
+	case deliveryExpired:
+		c.expired++
+	case deliverySent:
+		c.sent++
+	case deliveryBuffered:
+		c.buffered++
+	case deliveryBackpressure:
+		c.backpressure++
+	case deliveryClosed:
+		c.closed++
+	}
+}
+
+func (c *deliveryCounts) log() {
+	log.Printf("server: broadcast expired %v, sent %v, buffered %v, backpressure %v, closed %v",
+		c.expired, c.sent, c.buffered, c.backpressure, c.closed)
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -142,6 +387,12 @@ func (svr *Server) Serve() {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(svr, w, r)
 	})
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(svr, w, r)
+	})
+	http.HandleFunc("/events/send", func(w http.ResponseWriter, r *http.Request) {
+		serveEventsSend(svr, w, r)
+	})
 
 	err := http.ListenAndServe(*addr, nil)
 	if err != nil {
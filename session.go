@@ -0,0 +1,316 @@
+package buddy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const defaultSessionDuration = 24 * time.Hour
+
+const reaperInterval = 30 * time.Second
+
+// SessionToken identifies a Session across reconnects; it is handed to the
+// client as the websocket BasicAuth username and echoed back on every
+// subsequent connection attempt.
+type SessionToken string
+
+// Request pairs an inbound message with the Session it arrived on so
+// middleware can attribute and authorize it.
+type Request struct {
+	Session *Session
+	Data    []byte
+}
+
+func NewRequest(session *Session, data []byte) *Request {
+	return &Request{Session: session, Data: data}
+}
+
+const middlewareInBufferSize = 256
+
+// MiddlewarePipeline is the inbound processing chain: readPump hands every
+// client message to In, and whatever consumes it decides what happens next.
+type MiddlewarePipeline struct {
+	In chan *Request
+}
+
+func NewMiddlewarePipeline() *MiddlewarePipeline {
+	return &MiddlewarePipeline{
+		In: make(chan *Request, middlewareInBufferSize),
+	}
+}
+
+// Session tracks a single logical client across however many websocket
+// connections it makes (the token survives reconnects; the Client does not).
+type Session struct {
+	Token  SessionToken
+	Client *Client
+
+	expireTime time.Time
+
+	// LastAckSeq is the highest buffered message sequence number the client
+	// has confirmed receiving, via an inbound ack control frame. Messages at
+	// or below it are eligible for eager pruning from the replay buffer.
+	LastAckSeq uint64
+
+	// MaxHoldingSeconds is the TTL applied to this session's replay buffer;
+	// 0 means the session does not buffer missed messages at all.
+	MaxHoldingSeconds int
+
+	// ClientIP is the resolved real client address (see realClientIP in
+	// ip.go) of the most recent Client this session was attached to, so
+	// middleware can rate-limit/authorize on it.
+	ClientIP netip.Addr
+
+	// backpressureStrikes counts consecutive broadcasts that found this
+	// session's send channel full with no buffer to fall back on; see
+	// maxBackpressureStrikes in server.go.
+	backpressureStrikes int
+
+	// deliverMu serializes deliverToSession calls for this session.
+	// deliverLocalNow (on Run's goroutine) and deliverLocalPaced (on
+	// runPacedDelivery's goroutine) run on different goroutines; without
+	// this lock two calls at once would race on backpressureStrikes/
+	// expireTime and could both observe Client.send as open and
+	// double-close it.
+	deliverMu sync.Mutex
+
+	bufferMu sync.Mutex
+	buffer   *MessageBuffer
+}
+
+func NewSession(token SessionToken) *Session {
+	return &Session{
+		Token:      token,
+		expireTime: refreshExpiryTime(),
+	}
+}
+
+func refreshExpiryTime() time.Time {
+	return time.Now().Add(defaultSessionDuration)
+}
+
+func (s *Session) SessionExpired() bool {
+	return time.Now().After(s.expireTime)
+}
+
+// sessionDurationExpired mirrors SessionExpired; Client.Expired reads it
+// through the lowercase name to keep the check private to this package.
+func (s *Session) sessionDurationExpired() bool {
+	return s.SessionExpired()
+}
+
+// buf returns this session's replay buffer, lazily creating it the first
+// time it's needed. Returns nil when buffering is disabled.
+func (s *Session) buf() *MessageBuffer {
+	if s.MaxHoldingSeconds <= 0 {
+		return nil
+	}
+
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+
+	if s.buffer == nil {
+		s.buffer = NewMessageBuffer(s.MaxHoldingSeconds, defaultSessionBufferSize)
+	}
+	return s.buffer
+}
+
+// bufferIfExists returns the session's replay buffer without lazily
+// creating one, for callers that only need to act on a buffer if it's
+// already there. Takes the same lock as buf(), so it's safe to call
+// concurrently with it (and with itself) from another goroutine.
+func (s *Session) bufferIfExists() *MessageBuffer {
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+	return s.buffer
+}
+
+// recordAck advances LastAckSeq and eagerly prunes anything the client has
+// already confirmed, so the buffer doesn't hold onto acked messages until
+// the reaper's TTL sweep gets to them.
+func (s *Session) recordAck(seq uint64) {
+	if seq <= s.LastAckSeq {
+		return
+	}
+	s.LastAckSeq = seq
+
+	if buffer := s.bufferIfExists(); buffer != nil {
+		buffer.PruneAcked(seq)
+	}
+}
+
+// replayTo pushes any still-live buffered messages onto client.send in
+// sequence order, each tagged with its sequence number (see
+// encodeSequenced) so the JS client can dedupe against what it already has.
+func (s *Session) replayTo(client *Client) {
+	buffer := s.bufferIfExists()
+	if buffer == nil {
+		return
+	}
+
+	for _, m := range buffer.Live(s.LastAckSeq) {
+		select {
+		case client.send <- encodeSequenced(m.Seq, m.Data):
+		default:
+			// send filled back up already; give up and let the next
+			// broadcast re-buffer whatever's left
+			return
+		}
+	}
+}
+
+// encodeSequenced prepends seq to data for replay. If data was tagged
+// opaque (see MarkOpaque in transport.go), the marker has to stay at byte
+// 0 or wsTransport/writePump won't recognize it, so it's stripped off,
+// the sequence number is prepended to what's left, and the marker is
+// reapplied in front of that — otherwise a buffered opaque message would
+// come back from replay with its marker stuck mid-frame and get
+// double-compressed or corrupted.
+func encodeSequenced(seq uint64, data []byte) []byte {
+	prefix := []byte(fmt.Sprintf("%d|", seq))
+
+	if isOpaqueFrame(data) {
+		payload := bytes.TrimPrefix(data, opaqueFrameMarker)
+		return MarkOpaque(append(prefix, payload...))
+	}
+
+	return append(prefix, data...)
+}
+
+// SessionStore is the set of currently known sessions, keyed by token.
+type SessionStore interface {
+	Exists(token SessionToken) bool
+	NewSession() (SessionToken, error)
+	SetClient(token SessionToken, client *Client)
+	Get(token SessionToken) (*Session, bool)
+	Delete(token SessionToken)
+	Range(f func(key, value interface{}) bool)
+	Length() int
+}
+
+type defaultSessionStore struct {
+	mu       sync.RWMutex
+	sessions map[SessionToken]*Session
+
+	// bufferTTLSeconds is stamped onto every Session this store creates, as
+	// Session.MaxHoldingSeconds; see WithSessionBufferTTL in server.go.
+	bufferTTLSeconds int
+}
+
+// NewDefaultSessionManager builds a SessionStore whose sessions buffer
+// missed broadcasts for bufferTTLSeconds before they age out of replay; 0
+// disables buffering entirely (a session's MessageBuffer is never created).
+func NewDefaultSessionManager(bufferTTLSeconds int) SessionStore {
+	store := &defaultSessionStore{
+		sessions:         make(map[SessionToken]*Session),
+		bufferTTLSeconds: bufferTTLSeconds,
+	}
+	go store.runReaper()
+	return store
+}
+
+// newSessionLocked builds a Session with this store's configured buffer
+// TTL applied. Caller must hold s.mu.
+func (s *defaultSessionStore) newSessionLocked(token SessionToken) *Session {
+	session := NewSession(token)
+	session.MaxHoldingSeconds = s.bufferTTLSeconds
+	return session
+}
+
+func (s *defaultSessionStore) Exists(token SessionToken) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.sessions[token]
+	return ok
+}
+
+func (s *defaultSessionStore) NewSession() (SessionToken, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.sessions[token] = s.newSessionLocked(token)
+	s.mu.Unlock()
+
+	return token, nil
+}
+
+func (s *defaultSessionStore) SetClient(token SessionToken, client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok {
+		session = s.newSessionLocked(token)
+		s.sessions[token] = session
+	}
+	session.Client = client
+	session.ClientIP = client.clientIP
+	client.session = session
+}
+
+func (s *defaultSessionStore) Get(token SessionToken) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[token]
+	return session, ok
+}
+
+func (s *defaultSessionStore) Delete(token SessionToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+func (s *defaultSessionStore) Range(f func(key, value interface{}) bool) {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	for _, session := range sessions {
+		if !f(session.Token, session) {
+			break
+		}
+	}
+}
+
+func (s *defaultSessionStore) Length() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+// runReaper periodically sweeps every session's replay buffer for entries
+// older than its MaxHoldingSeconds.
+func (s *defaultSessionStore) runReaper() {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.Range(func(key, value interface{}) bool {
+			session := value.(*Session)
+			if session.buffer != nil {
+				session.buffer.reap()
+			}
+			return true
+		})
+	}
+}
+
+func newSessionToken() (SessionToken, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return SessionToken(hex.EncodeToString(raw)), nil
+}
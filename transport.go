@@ -0,0 +1,82 @@
+package buddy
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// Transport is the outbound half of a Client's connection: writePump calls
+// it to deliver a batch of queued bytes, ping the peer, or tear down the
+// connection, without caring whether the peer is a websocket or an SSE
+// stream. Inbound delivery stays transport-specific (readPump for
+// websockets, the /events/send handler for SSE) since the two have no
+// shared shape.
+type Transport interface {
+	WriteMessage(data []byte) error
+	Ping() error
+	Close() error
+}
+
+// opaqueFrameMarker prefixes an outbound message that's already compressed
+// (or otherwise shouldn't be run through permessage-deflate again, e.g. a
+// precomputed binary blob); wsTransport strips it and writes the rest of
+// the frame with write compression disabled.
+var opaqueFrameMarker = []byte{0x00}
+
+// MarkOpaque tags data so it's delivered with per-message compression
+// disabled instead of being run through permessage-deflate, e.g. for an
+// already-compressed or binary payload that would double-compress or
+// corrupt under the upgrader's compression. Pass the result to
+// Server.broadcastAll or a Client's send channel in place of the raw
+// payload; writePump also keeps an opaque frame out of the same batch as
+// any plain-text messages queued alongside it.
+func MarkOpaque(data []byte) []byte {
+	tagged := make([]byte, 0, len(opaqueFrameMarker)+len(data))
+	tagged = append(tagged, opaqueFrameMarker...)
+	tagged = append(tagged, data...)
+	return tagged
+}
+
+// isOpaqueFrame reports whether data was tagged by MarkOpaque.
+func isOpaqueFrame(data []byte) bool {
+	return bytes.HasPrefix(data, opaqueFrameMarker)
+}
+
+// wsTransport is the Transport backing a websocket Client, used by serveWs.
+type wsTransport struct {
+	conn   *websocket.Conn
+	config ClientConfig
+}
+
+func newWSTransport(conn *websocket.Conn, config ClientConfig) *wsTransport {
+	return &wsTransport{conn: conn, config: config}
+}
+
+func (t *wsTransport) WriteMessage(data []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.config.WriteWait))
+
+	if opaque := isOpaqueFrame(data); opaque {
+		data = bytes.TrimPrefix(data, opaqueFrameMarker)
+		t.conn.EnableWriteCompression(false)
+		defer t.conn.EnableWriteCompression(t.config.EnableCompression)
+	}
+
+	w, err := t.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (t *wsTransport) Ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.config.WriteWait))
+	return t.conn.WriteMessage(websocket.PingMessage, []byte{})
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}